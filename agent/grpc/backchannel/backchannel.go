@@ -0,0 +1,33 @@
+// Package backchannel lets a Consul server issue gRPC calls back to the
+// agent that dialed it, reusing the same TCP connection the agent already
+// established rather than requiring the agent to be independently
+// reachable. This is needed behind NAT/firewalls, and is used by
+// subsystems such as xDS and health push that need to notify an agent
+// without the agent running its own externally-reachable gRPC server.
+//
+// Every connection between an agent and a server is wrapped in a yamux
+// session so it can carry gRPC traffic in both directions simultaneously:
+// one or more yamux streams opened by the agent serve as the transport for
+// its own outbound *grpc.ClientConn (the normal agent -> server RPCs),
+// while streams opened by the server arrive on a yamux listener that the
+// agent's own grpc.Server answers (the backchannel).
+package backchannel
+
+import (
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// yamuxConfig returns the configuration used for every backchannel
+// session. Keep-alives (every 30 seconds) and a 10 second connection write
+// timeout are set explicitly, matching yamux's defaults, so a half-open TCP
+// connection is detected and torn down, since a stale entry here means the
+// server silently loses its ability to reach that agent.
+func yamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.EnableKeepAlive = true
+	cfg.KeepAliveInterval = 30 * time.Second
+	cfg.ConnectionWriteTimeout = 10 * time.Second
+	return cfg
+}
@@ -0,0 +1,90 @@
+package backchannel_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/hashicorp/consul/agent/grpc/backchannel"
+	"github.com/hashicorp/consul/agent/grpc/internal/testservice"
+	"github.com/hashicorp/consul/types"
+)
+
+// fakeAgent answers the backchannel RPC a server places back to the agent
+// that dialed it, reporting its own node ID so the test can assert the
+// call actually reached this process.
+type fakeAgent struct {
+	testservice.SimpleServer
+	nodeID string
+}
+
+func (f *fakeAgent) Something(ctx context.Context, _ *testservice.Req) (*testservice.Resp, error) {
+	return &testservice.Resp{ServerName: f.nodeID}, nil
+}
+
+// TestBackchannel_IntegrationRoundTrip dials a plain TCP connection from an
+// "agent" to a "server" listener, and verifies the server can use the
+// resulting registry entry to place a gRPC call back to the agent over
+// that same connection.
+func TestBackchannel_IntegrationRoundTrip(t *testing.T) {
+	const nodeID = types.NodeID("agent-1")
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	registry := backchannel.NewRegistry()
+	handshake := func(conn net.Conn) (types.NodeID, error) {
+		return nodeID, nil
+	}
+	backLis := backchannel.NewListener(lis, handshake, registry, hclog.NewNullLogger())
+	t.Cleanup(func() { backLis.Close() })
+
+	// The server's ordinary agent -> server RPC surface is unexercised by
+	// this test, but still needs to be served so the agent's forward
+	// dialer isn't left hanging.
+	fwdSrv := grpc.NewServer()
+	go fwdSrv.Serve(backLis)
+	t.Cleanup(fwdSrv.GracefulStop)
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	require.NoError(t, err)
+
+	dial, agentLis, err := backchannel.WrapClientConn(conn, hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	agentSrv := backchannel.NewBackchannelServer()
+	testservice.RegisterSimpleServer(agentSrv, &fakeAgent{nodeID: string(nodeID)})
+	go agentSrv.Serve(agentLis)
+	t.Cleanup(agentSrv.GracefulStop)
+
+	// Build (but don't use) the agent's outbound ClientConn over the
+	// returned dialer, the same way the ClientConnPool's wrappedDialer
+	// does. The yamux session itself is already running once
+	// WrapClientConn returns, and the server registers the agent as soon
+	// as it accepts the TCP connection.
+	_, err = grpc.Dial("backchannel", grpc.WithContextDialer(dial), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		_, err := registry.Dial(nodeID)
+		return err == nil
+	}, 2*time.Second, 10*time.Millisecond, "server never registered a backchannel connection for the agent")
+
+	backConn, err := registry.Dial(nodeID)
+	require.NoError(t, err)
+
+	client := testservice.NewSimpleClient(backConn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	resp, err := client.Something(ctx, &testservice.Req{})
+	require.NoError(t, err)
+	require.Equal(t, string(nodeID), resp.ServerName)
+}
@@ -0,0 +1,65 @@
+package backchannel
+
+import (
+	"context"
+	"net"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/yamux"
+	"google.golang.org/grpc"
+)
+
+// WrapClientConn takes a freshly dialed (and, if applicable, TLS-wrapped)
+// connection to a server and turns it into a yamux session carrying gRPC
+// in both directions. The returned dialer should be passed to
+// grpc.WithContextDialer when building the agent's outbound
+// *grpc.ClientConn to this server: every call to it opens a new yamux
+// stream over conn rather than a new TCP connection. A grpc.Server (see
+// NewBackchannelServer) should have Serve called on the returned
+// net.Listener so
+// that the server can call back into the agent over the same connection;
+// callers are responsible for running Serve in a goroutine and surfacing
+// its error (e.g. via errors.Is(err, grpc.ErrServerStopped) on shutdown)
+// instead of discarding it.
+func WrapClientConn(conn net.Conn, logger hclog.Logger) (dial func(context.Context, string) (net.Conn, error), backServer net.Listener, err error) {
+	session, err := yamux.Client(conn, yamuxConfig())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dial = func(ctx context.Context, _ string) (net.Conn, error) {
+		return session.OpenStream()
+	}
+
+	return dial, &sessionListener{session: session, logger: logger}, nil
+}
+
+// NewBackchannelServer constructs a grpc.Server intended to answer calls
+// that arrive over a client-side backchannel listener returned by
+// WrapClientConn. Callers register the services the server side is
+// allowed to invoke (e.g. xDS push, health check triggers) on it before
+// calling Serve.
+func NewBackchannelServer(opts ...grpc.ServerOption) *grpc.Server {
+	return grpc.NewServer(opts...)
+}
+
+// sessionListener adapts a *yamux.Session to the net.Listener interface
+// expected by grpc.Server.Serve, so that inbound streams opened by the
+// remote end of the session are handed to the gRPC server as if they were
+// newly accepted connections.
+type sessionListener struct {
+	session *yamux.Session
+	logger  hclog.Logger
+}
+
+func (l *sessionListener) Accept() (net.Conn, error) {
+	return l.session.AcceptStream()
+}
+
+func (l *sessionListener) Close() error {
+	return l.session.Close()
+}
+
+func (l *sessionListener) Addr() net.Addr {
+	return l.session.LocalAddr()
+}
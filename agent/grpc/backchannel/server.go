@@ -0,0 +1,204 @@
+package backchannel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/yamux"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"github.com/hashicorp/consul/types"
+)
+
+// Registry holds the backchannel *grpc.ClientConn for every agent
+// currently connected to this server. Server-side code that needs to call
+// back into an agent (xDS push, health check triggers, ...) looks the
+// connection up here by node ID instead of dialing the agent directly,
+// since the agent may not be reachable except via the connection it
+// already opened to us.
+type Registry struct {
+	mu     sync.RWMutex
+	byNode map[types.NodeID]*grpc.ClientConn
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{byNode: make(map[types.NodeID]*grpc.ClientConn)}
+}
+
+// Dial returns the backchannel connection to nodeID, if that node is
+// currently connected to this server.
+func (r *Registry) Dial(nodeID types.NodeID) (*grpc.ClientConn, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	conn, ok := r.byNode[nodeID]
+	if !ok {
+		return nil, fmt.Errorf("backchannel: no connection registered for node %s", nodeID)
+	}
+	return conn, nil
+}
+
+func (r *Registry) set(nodeID types.NodeID, conn *grpc.ClientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byNode[nodeID] = conn
+}
+
+// remove deletes the entry for nodeID, but only if it still points at
+// conn, so a connection that raced a newer one reconnecting doesn't evict
+// it.
+func (r *Registry) remove(nodeID types.NodeID, conn *grpc.ClientConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.byNode[nodeID] == conn {
+		delete(r.byNode, nodeID)
+	}
+}
+
+// Handshake identifies the agent on the other end of a freshly accepted
+// connection, so its backchannel *grpc.ClientConn can be registered under
+// the right node ID. Implementations typically read this off the verified
+// peer TLS certificate.
+type Handshake func(conn net.Conn) (types.NodeID, error)
+
+// WrapServerConn mirrors WrapClientConn for the server side of an accepted
+// connection: it wraps conn in the server end of a yamux session, opens an
+// outbound stream that becomes a *grpc.ClientConn registered in registry
+// under the node ID returned by handshake, and returns a net.Listener of
+// inbound streams for the main grpc.Server to Serve — these are the
+// ordinary agent -> server RPCs that already flow over this connection
+// today. The returned cleanup func must run once the inbound listener's
+// Accept loop exits, so the registry entry doesn't outlive the connection.
+func WrapServerConn(conn net.Conn, handshake Handshake, registry *Registry, logger hclog.Logger) (inbound net.Listener, cleanup func(), err error) {
+	nodeID, err := handshake(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backchannel: identifying peer: %w", err)
+	}
+
+	session, err := yamux.Server(conn, yamuxConfig())
+	if err != nil {
+		return nil, nil, fmt.Errorf("backchannel: starting yamux session: %w", err)
+	}
+
+	dial := func(ctx context.Context, _ string) (net.Conn, error) {
+		return session.OpenStream()
+	}
+	backConn, err := grpc.Dial(
+		"backchannel",
+		grpc.WithContextDialer(dial),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		session.Close()
+		return nil, nil, fmt.Errorf("backchannel: dialing node %s: %w", nodeID, err)
+	}
+	registry.set(nodeID, backConn)
+
+	cleanup = func() {
+		registry.remove(nodeID, backConn)
+		backConn.Close()
+		session.Close()
+	}
+	return &sessionListener{session: session, logger: logger}, cleanup, nil
+}
+
+// acceptResult carries either a newly accepted inbound stream, or the
+// error that ended one connection's accept loop, through Listener's fan-in
+// channel.
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// Listener wraps a raw net.Listener (the server's normal gRPC listener) so
+// every accepted connection is treated as a backchannel session: each
+// connection's inbound streams are fanned in to this Listener's own
+// Accept, for a single grpc.Server to Serve, while an outbound stream per
+// connection is registered in registry as that node's backchannel
+// ClientConn.
+type Listener struct {
+	listener  net.Listener
+	handshake Handshake
+	registry  *Registry
+	logger    hclog.Logger
+
+	streams   chan acceptResult
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewListener starts accepting from listener and returns a net.Listener
+// whose Accept yields the inbound (agent -> server) streams multiplexed
+// over every connection accepted so far.
+func NewListener(listener net.Listener, handshake Handshake, registry *Registry, logger hclog.Logger) *Listener {
+	l := &Listener{
+		listener:  listener,
+		handshake: handshake,
+		registry:  registry,
+		logger:    logger,
+		streams:   make(chan acceptResult),
+		closeCh:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case l.streams <- acceptResult{err: err}:
+			case <-l.closeCh:
+			}
+			return
+		}
+		go l.handleConn(conn)
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	inbound, cleanup, err := WrapServerConn(conn, l.handshake, l.registry, l.logger)
+	if err != nil {
+		l.logger.Warn("backchannel: dropping connection that failed to establish", "error", err)
+		conn.Close()
+		return
+	}
+	defer cleanup()
+
+	for {
+		stream, err := inbound.Accept()
+		if err != nil {
+			return
+		}
+		select {
+		case l.streams <- acceptResult{conn: stream}:
+		case <-l.closeCh:
+			stream.Close()
+			return
+		}
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case r := <-l.streams:
+		return r.conn, r.err
+	case <-l.closeCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closeCh) })
+	return l.listener.Close()
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.listener.Addr()
+}
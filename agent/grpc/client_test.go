@@ -11,8 +11,12 @@ import (
 	"time"
 
 	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/yamux"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 
+	"github.com/hashicorp/consul/agent/grpc/internal/testhelper"
 	"github.com/hashicorp/consul/agent/grpc/internal/testservice"
 	"github.com/hashicorp/consul/agent/grpc/resolver"
 	"github.com/hashicorp/consul/agent/metadata"
@@ -33,7 +37,10 @@ func TestNewDialer_WithTLSWrapper(t *testing.T) {
 
 	lis, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(ports[0])))
 	require.NoError(t, err)
-	t.Cleanup(logError(t, lis.Close))
+	// gRPC, not the test, owns closing lis: MustServe stops the server
+	// (and with it the listener) during cleanup and asserts Serve exited
+	// cleanly.
+	testhelper.MustServe(t, grpc.NewServer(), lis)
 
 	builder, err := resolver.NewServerResolverBuilder(resolver.Config{})
 	require.NoError(t, err)
@@ -299,6 +306,127 @@ func TestClientConnPool_IntegrationWithGRPCResolver_MultiDC(t *testing.T) {
 	}
 }
 
+func TestClientConnPool_KeyedByCredentials(t *testing.T) {
+	res, err := resolver.NewServerResolverBuilder(newConfig(t))
+	require.NoError(t, err)
+	registerWithGRPC(t, res)
+	pool := NewClientConnPool(
+		res,
+		nil,
+		nil,
+		nil,
+		useTLSForDcAlwaysTrue,
+		true,
+		"dc1",
+	)
+
+	srv := newTestServer(t, "server-1", "dc1")
+	res.AddServer(srv.Metadata())
+	t.Cleanup(srv.shutdown)
+
+	connA, err := pool.ClientConnWithCreds("dc1", CallCredentials{Token: "token-a"})
+	require.NoError(t, err)
+	connB, err := pool.ClientConnWithCreds("dc1", CallCredentials{Token: "token-b"})
+	require.NoError(t, err)
+
+	require.NotSame(t, connA, connB, "different tokens must not share a ClientConn")
+
+	// Requesting the same token again returns the same cached connection.
+	connA2, err := pool.ClientConnWithCreds("dc1", CallCredentials{Token: "token-a"})
+	require.NoError(t, err)
+	require.Same(t, connA, connA2)
+
+	// Both connections work concurrently against the same DC.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+
+	clientA := testservice.NewSimpleClient(connA)
+	clientB := testservice.NewSimpleClient(connB)
+
+	respA, err := clientA.Something(ctx, &testservice.Req{})
+	require.NoError(t, err)
+	require.Equal(t, "server-1", respA.ServerName)
+	require.Equal(t, "token-a", respA.Token, "connA must present token-a as PerRPCCredentials")
+
+	respB, err := clientB.Something(ctx, &testservice.Req{})
+	require.NoError(t, err)
+	require.Equal(t, "server-1", respB.ServerName)
+	require.Equal(t, "token-b", respB.Token, "connB must present token-b as PerRPCCredentials")
+}
+
+// TestClientConnPool_BackchannelEvictionClosesSession verifies that
+// evicting an idle, backchannel-wrapped pool entry tears down the whole
+// yamux session it opened — not just the single gRPC stream handed to the
+// outbound *grpc.ClientConn — so the underlying socket closes and the
+// goroutine running the backchannel server over it exits.
+func TestClientConnPool_BackchannelEvictionClosesSession(t *testing.T) {
+	// A minimal stand-in for the server side of the backchannel: wrap the
+	// single accepted connection in the server end of yamux, answer the
+	// agent's outbound gRPC streams on it, and report, via sessionClosed,
+	// once that session (and so the underlying TCP connection) has
+	// actually gone away.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { lis.Close() })
+
+	sessionClosed := make(chan struct{})
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		session, err := yamux.Server(conn, yamux.DefaultConfig())
+		if err != nil {
+			conn.Close()
+			return
+		}
+		// *yamux.Session is a net.Listener of the streams the agent opens,
+		// so a plain grpc.Server can send the HTTP/2 preface the agent's
+		// ClientConn waits for before it is Ready. Serve returns once the
+		// session is closed.
+		grpc.NewServer().Serve(session)
+		close(sessionClosed)
+	}()
+
+	res, err := resolver.NewServerResolverBuilder(newConfig(t))
+	require.NoError(t, err)
+	registerWithGRPC(t, res)
+	res.AddServer(&metadata.Server{
+		Name:       "server-1",
+		ID:         "server-1",
+		Datacenter: "dc1",
+		Addr:       lis.Addr(),
+	})
+
+	pool := NewClientConnPool(
+		res,
+		nil,
+		nil,
+		nil,
+		func(string) bool { return false },
+		false, // dialingFromServer: false, so the backchannel hook is active
+		"dc1",
+	)
+	pool.idleTimeout = time.Millisecond
+	pool.SetBackchannelServer(grpc.NewServer(), hclog.NewNullLogger())
+
+	conn, err := pool.ClientConnWithCreds("dc1", CallCredentials{Token: "evict-me"})
+	require.NoError(t, err)
+	conn.Connect()
+
+	require.Eventually(t, func() bool {
+		return conn.GetState() == connectivity.Ready
+	}, 2*time.Second, 10*time.Millisecond, "agent -> server connection never became ready")
+
+	pool.evictIdleConns()
+
+	select {
+	case <-sessionClosed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("backchannel session was never closed on eviction; socket/goroutine leaked")
+	}
+}
+
 func registerWithGRPC(t *testing.T, b *resolver.ServerResolverBuilder) {
 	resolver.Register(b)
 	t.Cleanup(func() {
@@ -0,0 +1,34 @@
+// Package testhelper provides small test-only utilities shared across the
+// agent/grpc test suites.
+package testhelper
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+// MustServe runs srv.Serve(lis) in a background goroutine and registers a
+// t.Cleanup that gracefully stops srv and asserts that Serve returned
+// either nil or grpc.ErrServerStopped. Any other error — including
+// net.ErrClosed from a listener that was closed out from under the
+// server — fails the test instead of letting a leaked or prematurely
+// killed server silently pass between subtests.
+func MustServe(t *testing.T, srv *grpc.Server, lis net.Listener) {
+	t.Helper()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(lis)
+	}()
+
+	t.Cleanup(func() {
+		srv.GracefulStop()
+		if err := <-errCh; err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			require.NoError(t, err, "grpc.Server.Serve returned an unexpected error")
+		}
+	})
+}
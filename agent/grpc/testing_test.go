@@ -0,0 +1,102 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	grpcmetadata "google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/hashicorp/consul/agent/grpc/internal/testhelper"
+	"github.com/hashicorp/consul/agent/grpc/internal/testservice"
+	"github.com/hashicorp/consul/agent/metadata"
+	"github.com/hashicorp/consul/sdk/freeport"
+	"github.com/hashicorp/consul/tlsutil"
+)
+
+// rpcServer is the fake server-side RPC implementation backing a
+// testServer. It records whether each accepted connection completed a TLS
+// handshake so that tests can assert on it.
+type rpcServer struct {
+	testservice.SimpleServer
+
+	name               string
+	dc                 string
+	tlsConf            *tlsutil.Configurator
+	tlsConnEstablished int32
+}
+
+// Something implements testservice.SimpleServer. It reports the server's
+// own name/datacenter so tests can tell which of several backing servers
+// answered a call, records whether the peer connection was over TLS, and
+// echoes back whatever ACL token arrived as PerRPCCredentials metadata so
+// tests can assert on which credentials a given connection actually used.
+func (r *rpcServer) Something(ctx context.Context, _ *testservice.Req) (*testservice.Resp, error) {
+	if p, ok := peer.FromContext(ctx); ok {
+		if _, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			atomic.AddInt32(&r.tlsConnEstablished, 1)
+		}
+	}
+
+	var token string
+	if md, ok := grpcmetadata.FromIncomingContext(ctx); ok {
+		if vals := md.Get("x-consul-token"); len(vals) > 0 {
+			token = vals[0]
+		}
+	}
+
+	return &testservice.Resp{ServerName: r.name, Datacenter: r.dc, Token: token}, nil
+}
+
+// testServer is a minimal standalone gRPC server used by the dialer and
+// pool tests in this package to exercise real TCP/TLS connections without
+// needing a full agent.
+type testServer struct {
+	name string
+	dc   string
+	rpc  *rpcServer
+	srv  *grpc.Server
+	lis  net.Listener
+}
+
+func (s testServer) Metadata() *metadata.Server {
+	return &metadata.Server{
+		Name:       s.name,
+		ID:         s.name,
+		Datacenter: s.dc,
+		Addr:       s.lis.Addr(),
+		UseTLS:     s.rpc.tlsConf != nil && s.rpc.tlsConf.UseTLS(s.dc),
+	}
+}
+
+// shutdown gracefully stops the server. testhelper.MustServe already
+// asserts that Serve exits cleanly when this runs, so callers can still
+// register it via t.Cleanup(srv.shutdown) purely to control ordering
+// (e.g. stopping a server before removing it from a resolver).
+func (s testServer) shutdown() {
+	s.srv.GracefulStop()
+}
+
+// newTestServer starts a grpc.Server on a free port and registers the
+// testservice.Simple service, using name/dc to identify itself to callers
+// of Something.
+func newTestServer(t *testing.T, name, dc string) testServer {
+	t.Helper()
+
+	addr := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: freeport.MustTake(1)[0]}
+	lis, err := net.Listen("tcp", addr.String())
+	require.NoError(t, err)
+
+	rpc := &rpcServer{name: name, dc: dc}
+	srv := grpc.NewServer()
+	testservice.RegisterSimpleServer(srv, rpc)
+
+	testhelper.MustServe(t, srv, lis)
+
+	return testServer{name: name, dc: dc, rpc: rpc, srv: srv, lis: lis}
+}